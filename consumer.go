@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// EventConsumer runs ImageProcessor.HandleS3Event against a continuous
+// stream of bucket notifications, letting this processor run as a
+// long-lived container next to MinIO instead of behind AWS Lambda.
+// Selected via MODE=consumer, with the feed chosen by EVENT_SOURCE
+// ("sqs" or "http").
+type EventConsumer struct {
+	processor     *ImageProcessor
+	maxConcurrent int
+	semaphore     chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewEventConsumer builds an EventConsumer that hands off decoded bucket
+// notifications to processor, running at most maxConcurrent HandleS3Event
+// invocations at a time.
+func NewEventConsumer(processor *ImageProcessor, maxConcurrent int) *EventConsumer {
+	return &EventConsumer{
+		processor:     processor,
+		maxConcurrent: maxConcurrent,
+		semaphore:     make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Run consumes from the configured EVENT_SOURCE until ctx is canceled, then
+// waits for any in-flight HandleS3Event calls to finish before returning.
+func (c *EventConsumer) Run(ctx context.Context) error {
+	var err error
+	switch strings.ToLower(os.Getenv("EVENT_SOURCE")) {
+	case "sqs":
+		err = c.runSQS(ctx)
+	case "http":
+		err = c.runHTTP(ctx)
+	default:
+		err = fmt.Errorf("unknown EVENT_SOURCE: %q (expected \"sqs\" or \"http\")", os.Getenv("EVENT_SOURCE"))
+	}
+
+	c.wg.Wait()
+	return err
+}
+
+// handleRecords processes one notification's records in the background,
+// bounded by the consumer's concurrency limit. If onDone is non-nil, it is
+// called with the processing result once HandleS3Event returns, so the
+// caller can decide whether it's safe to acknowledge the source message.
+func (c *EventConsumer) handleRecords(records []events.S3EventRecord, onDone func(error)) {
+	c.semaphore <- struct{}{}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() { <-c.semaphore }()
+
+		err := c.processor.HandleS3Event(context.Background(), events.S3Event{Records: records})
+		if err != nil {
+			log.Printf("Error handling bucket notification: %v", err)
+		}
+		if onDone != nil {
+			onDone(err)
+		}
+	}()
+}
+
+// runSQS long-polls SQS_QUEUE_URL, decoding each message as a bucket
+// notification (either a raw S3 event or one wrapped in an SNS envelope)
+// and deleting it only once HandleS3Event has actually succeeded for it.
+// A message whose processing fails is left on the queue so SQS's own
+// visibility timeout/DLQ redelivery applies, instead of being silently
+// dropped.
+func (c *EventConsumer) runSQS(ctx context.Context) error {
+	queueURL := os.Getenv("SQS_QUEUE_URL")
+	if queueURL == "" {
+		return fmt.Errorf("SQS_QUEUE_URL is required when EVENT_SOURCE=sqs")
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))})
+	if err != nil {
+		return fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	client := sqs.New(sess)
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		out, err := client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("Failed to receive SQS messages: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, msg := range out.Messages {
+			records, err := decodeBucketNotification([]byte(aws.StringValue(msg.Body)))
+			if err != nil {
+				log.Printf("Failed to decode SQS message: %v", err)
+				continue
+			}
+
+			receiptHandle := msg.ReceiptHandle
+			c.handleRecords(records, func(procErr error) {
+				if procErr != nil {
+					// Leave the message on the queue; its visibility
+					// timeout expiring (and eventual DLQ redelivery, if
+					// configured) is the retry path.
+					return
+				}
+				if _, err := client.DeleteMessageWithContext(context.Background(), &sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(queueURL),
+					ReceiptHandle: receiptHandle,
+				}); err != nil {
+					log.Printf("Failed to delete SQS message: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// runHTTP serves MinIO's webhook notification target: a POST endpoint that
+// receives the same S3-event-shaped JSON MinIO sends for bucket events.
+func (c *EventConsumer) runHTTP(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notify", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		records, err := decodeBucketNotification(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c.handleRecords(records, nil)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	addr := ":" + envOrDefault("PORT", "8080")
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Starting bucket-notification HTTP listener on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		return err
+	}
+}
+
+// decodeBucketNotification parses a bucket-notification payload into S3
+// event records. It accepts both a raw S3-event-shaped body (as MinIO
+// delivers, and as S3->SQS direct subscriptions do) and the SNS envelope
+// used by S3->SNS->SQS fan-out.
+func decodeBucketNotification(body []byte) ([]events.S3EventRecord, error) {
+	var envelope struct {
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Type == "Notification" {
+		body = []byte(envelope.Message)
+	}
+
+	var s3Event events.S3Event
+	if err := json.Unmarshal(body, &s3Event); err != nil {
+		return nil, fmt.Errorf("failed to decode bucket notification: %w", err)
+	}
+	return s3Event.Records, nil
+}
@@ -0,0 +1,16 @@
+//go:build avif
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/Kagami/go-avif"
+)
+
+// encodeAVIF encodes img as AVIF using libaom via CGO. Enabled with -tags
+// avif when libaom is available on the build host.
+func encodeAVIF(w io.Writer, img image.Image) error {
+	return avif.Encode(w, img, nil)
+}
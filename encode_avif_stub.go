@@ -0,0 +1,15 @@
+//go:build !avif
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// encodeAVIF is unavailable in this build. Rebuild with -tags avif (requires
+// libaom via CGO) to enable AVIF output.
+func encodeAVIF(w io.Writer, img image.Image) error {
+	return fmt.Errorf("AVIF encoding requires building with -tags avif (libaom via CGO)")
+}
@@ -0,0 +1,21 @@
+//go:build libwebp
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+)
+
+// encodeWebP encodes img as WebP using libwebp via CGO. Enabled with -tags
+// libwebp when libwebp headers are available on the build host.
+func encodeWebP(w io.Writer, img image.Image) error {
+	options, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, 90)
+	if err != nil {
+		return err
+	}
+	return webp.Encode(w, img, options)
+}
@@ -0,0 +1,17 @@
+//go:build !libwebp
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// encodeWebP encodes img as WebP using the pure-Go nativewebp codec. This is
+// the default encoder so the processor builds and runs without CGO. Build
+// with -tags libwebp to swap in the cgo-accelerated libwebp encoder instead.
+func encodeWebP(w io.Writer, img image.Image) error {
+	return nativewebp.Encode(w, img, nil)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// maxInputDimension guards against decode bombs: upstream images whose
+// declared width or height exceeds this are rejected before a full decode
+// is attempted.
+const maxInputDimension = 10000
+
+// maxOutputDimension caps the w/h a caller can request a resize to, so a
+// request like w=50000&h=50000 can't force a multi-gigabyte output buffer.
+const maxOutputDimension = 4000
+
+// resizeMetrics are simple Prometheus-style counters for the on-demand
+// resize handler, exposed in text format at /metrics.
+type resizeMetrics struct {
+	hits    int64
+	misses  int64
+	rejects int64
+}
+
+func (m *resizeMetrics) writePrometheusText(w io.Writer) {
+	fmt.Fprintf(w, "# HELP resize_requests_total Resize requests by outcome.\n")
+	fmt.Fprintf(w, "# TYPE resize_requests_total counter\n")
+	fmt.Fprintf(w, "resize_requests_total{outcome=\"hit\"} %d\n", atomic.LoadInt64(&m.hits))
+	fmt.Fprintf(w, "resize_requests_total{outcome=\"miss\"} %d\n", atomic.LoadInt64(&m.misses))
+	fmt.Fprintf(w, "resize_requests_total{outcome=\"reject\"} %d\n", atomic.LoadInt64(&m.rejects))
+}
+
+// ResizeHandler serves on-demand image resizes over HTTP, in the style of
+// GitLab Workhorse's image_resizer: GET /resize?key=path/to.jpg&w=800&h=600
+// &fit=fill|fit|landscape|portrait&fmt=jpeg|webp, with results cached as
+// derivatives in the destination bucket. Selected via MODE=http.
+type ResizeHandler struct {
+	store             ObjectStore
+	sourceBucket      string
+	destinationBucket string
+	signingSecret     string
+	semaphore         chan struct{}
+	metrics           resizeMetrics
+}
+
+// NewResizeHandler builds a ResizeHandler from the process environment.
+func NewResizeHandler() *ResizeHandler {
+	store, err := NewObjectStore()
+	if err != nil {
+		log.Fatalf("failed to initialize object store: %v", err)
+	}
+
+	maxConcurrent := 2 * runtime.NumCPU()
+	if v := os.Getenv("MAX_CONCURRENT_RESIZES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxConcurrent = n
+		}
+	}
+
+	return &ResizeHandler{
+		store:             store,
+		sourceBucket:      os.Getenv("SOURCE_BUCKET"),
+		destinationBucket: os.Getenv("DESTINATION_BUCKET"),
+		signingSecret:     os.Getenv("SIGNING_SECRET"),
+		semaphore:         make(chan struct{}, maxConcurrent),
+	}
+}
+
+func (h *ResizeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/resize":
+		h.serveResize(w, r)
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.metrics.writePrometheusText(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *ResizeHandler) serveResize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if !h.verifySignature(query) {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, "invalid or missing signature", http.StatusForbidden)
+		return
+	}
+
+	key := query.Get("key")
+	if key == "" {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	width, _ := strconv.Atoi(query.Get("w"))
+	height, _ := strconv.Atoi(query.Get("h"))
+	fit := query.Get("fit")
+	format := strings.ToLower(query.Get("fmt"))
+	if format == "" {
+		format = "jpeg"
+	}
+
+	if width <= 0 || height <= 0 || width > maxOutputDimension || height > maxOutputDimension {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, fmt.Sprintf("w and h must be positive and at most %d", maxOutputDimension), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.semaphore <- struct{}{}:
+		defer func() { <-h.semaphore }()
+	case <-r.Context().Done():
+		return
+	}
+
+	cacheKey := resizeCacheKey(key, width, height, fit, format)
+
+	if body, contentType, ok := h.getCached(r.Context(), cacheKey); ok {
+		defer body.Close()
+		atomic.AddInt64(&h.metrics.hits, 1)
+		w.Header().Set("Content-Type", contentType)
+		io.Copy(w, body)
+		return
+	}
+
+	atomic.AddInt64(&h.metrics.misses, 1)
+
+	data, err := h.downloadSource(r.Context(), key)
+	if err != nil {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, fmt.Sprintf("failed to fetch source image: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, "failed to decode source image", http.StatusBadRequest)
+		return
+	}
+	if cfg.Width > maxInputDimension || cfg.Height > maxInputDimension {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, "source image exceeds maximum allowed dimensions", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		atomic.AddInt64(&h.metrics.rejects, 1)
+		http.Error(w, "failed to decode source image", http.StatusBadRequest)
+		return
+	}
+
+	resized := resizeImage(img, ImageSize{Width: width, Height: height, Format: resizeModeForFit(fit)})
+
+	encoded, contentType, err := encodeImage(format, resized)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode derivative: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.store.Put(r.Context(), h.destinationBucket, cacheKey, bytes.NewReader(encoded), contentType, nil); err != nil {
+		log.Printf("Failed to cache derivative %s: %v", cacheKey, err)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(encoded)
+}
+
+// resizeModeForFit maps the public fit= query values onto the internal
+// ImageSize.Format resize modes.
+func resizeModeForFit(fit string) string {
+	switch fit {
+	case "fill":
+		return "square"
+	case "landscape":
+		return "landscape"
+	case "portrait":
+		return "portrait"
+	default:
+		return "default"
+	}
+}
+
+// resizeCacheKey derives the destination-bucket key a derivative is cached
+// under for a given resize request.
+func resizeCacheKey(key string, width, height int, fit, format string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s", key, width, height, fit, format)))
+	return fmt.Sprintf("_cache/%x%s", sum, extensionForFormat(format))
+}
+
+func (h *ResizeHandler) getCached(ctx context.Context, cacheKey string) (io.ReadCloser, string, bool) {
+	body, metadata, err := h.store.Get(ctx, h.destinationBucket, cacheKey)
+	if err != nil {
+		return nil, "", false
+	}
+	contentType := "application/octet-stream"
+	if ct := metadata["Content-Type"]; ct != "" {
+		contentType = ct
+	}
+	return body, contentType, true
+}
+
+func (h *ResizeHandler) downloadSource(ctx context.Context, key string) ([]byte, error) {
+	body, _, err := h.store.Get(ctx, h.sourceBucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// verifySignature checks the request's sig query param against an
+// HMAC-SHA256 computed over the remaining query params, following the same
+// pattern as Notifier.calculateSignature.
+func (h *ResizeHandler) verifySignature(query url.Values) bool {
+	if h.signingSecret == "" {
+		return false
+	}
+	provided := query.Get("sig")
+	if provided == "" {
+		return false
+	}
+
+	expected := hmacSHA256Hex(h.signingSecret, []byte(canonicalizeQuery(query)))
+	return hmac.Equal([]byte(expected), []byte(provided))
+}
+
+// canonicalizeQuery builds a deterministic string of the query params
+// (excluding sig) for signing/verification.
+func canonicalizeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k == "sig" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(query.Get(k))
+	}
+	return b.String()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalizeQueryExcludesSigAndSorts(t *testing.T) {
+	query := url.Values{
+		"w":   {"200"},
+		"h":   {"200"},
+		"sig": {"deadbeef"},
+		"key": {"foo.jpg"},
+	}
+
+	got := canonicalizeQuery(query)
+	want := "h=200&key=foo.jpg&w=200"
+	if got != want {
+		t.Fatalf("canonicalizeQuery() = %q, want %q", got, want)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	h := &ResizeHandler{signingSecret: "topsecret"}
+
+	query := url.Values{"key": {"foo.jpg"}, "w": {"200"}, "h": {"200"}}
+	query.Set("sig", hmacSHA256Hex(h.signingSecret, []byte(canonicalizeQuery(query))))
+
+	if !h.verifySignature(query) {
+		t.Fatal("expected a correctly signed request to verify")
+	}
+
+	query.Set("sig", "0000000000000000000000000000000000000000000000000000000000000000")
+	if h.verifySignature(query) {
+		t.Fatal("expected a tampered signature to fail verification")
+	}
+}
+
+func TestVerifySignatureRequiresSigningSecret(t *testing.T) {
+	h := &ResizeHandler{}
+	query := url.Values{"key": {"foo.jpg"}, "sig": {"anything"}}
+	if h.verifySignature(query) {
+		t.Fatal("expected verifySignature to fail when no signing secret is configured")
+	}
+}
+
+func TestVerifySignatureRequiresSigParam(t *testing.T) {
+	h := &ResizeHandler{signingSecret: "topsecret"}
+	query := url.Values{"key": {"foo.jpg"}}
+	if h.verifySignature(query) {
+		t.Fatal("expected verifySignature to fail when sig is missing")
+	}
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"image"
 	"image/gif"
@@ -10,16 +14,17 @@ import (
 	"image/png"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/disintegration/imaging"
 	"golang.org/x/sync/errgroup"
 
@@ -27,16 +32,36 @@ import (
 )
 
 type ImageProcessor struct {
-	s3Client          *s3.S3
+	store             ObjectStore
 	notifier          *Notifier
 	destinationBucket string
+	outputFormats     []string
 }
 
 type ImageSize struct {
-	Name   string
-	Width  int
-	Height int
-	Format string // "default", "square", "landscape", "portrait"
+	Name    string
+	Width   int
+	Height  int
+	Format  string   // resize mode: "default", "square", "landscape", "portrait"
+	Formats []string // output encodings for this size, e.g. ["webp", "jpeg"]; falls back to outputFormats when empty
+}
+
+// ProcessedDerivative describes one resized+encoded output produced from a
+// source image, used both for uploading and for reporting back via webhook.
+type ProcessedDerivative struct {
+	Size   ImageSize
+	Format string
+	Key    string
+}
+
+// processedMarker is the JSON body stored at _processed/<hash>.json once an
+// image has been fully processed. It makes re-delivery of the same S3 event
+// idempotent: a later invocation for the same bucket/key, source bytes, size
+// list and output formats (see contentHash) skips redoing the work and
+// replays the cached webhook instead.
+type processedMarker struct {
+	Derivatives []ProcessedDerivative `json:"derivatives"`
+	Webhook     *WebhookPayload       `json:"webhook,omitempty"`
 }
 
 var supportedFormats = map[string]bool{
@@ -55,11 +80,54 @@ var imageSizes = []ImageSize{
 }
 
 func NewImageProcessor() *ImageProcessor {
-	sess := session.Must(session.NewSession())
+	store, err := NewObjectStore()
+	if err != nil {
+		log.Fatalf("failed to initialize object store: %v", err)
+	}
+	destinationBucket := os.Getenv("DESTINATION_BUCKET")
 	return &ImageProcessor{
-		s3Client:          s3.New(sess),
-		notifier:          NewNotifier(),
-		destinationBucket: os.Getenv("DESTINATION_BUCKET"),
+		store:             store,
+		notifier:          NewNotifier(store, destinationBucket),
+		destinationBucket: destinationBucket,
+		outputFormats:     parseOutputFormats(os.Getenv("OUTPUT_FORMATS")),
+	}
+}
+
+// parseOutputFormats parses the comma-separated OUTPUT_FORMATS env var (e.g.
+// "webp,avif,jpeg") into a normalized list. An empty/unset value yields nil,
+// which tells processImage to keep each derivative in the source format.
+// "avif" only encodes successfully in binaries built with -tags avif and
+// libaom available at build time; see encode_avif_stub.go/encode_avif_cgo.go.
+func parseOutputFormats(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	formats := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if f := strings.ToLower(strings.TrimSpace(p)); f != "" {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// extensionForFormat returns the file extension to use for a derivative
+// encoded in the given format.
+func extensionForFormat(format string) string {
+	switch format {
+	case "jpeg", "jpg":
+		return ".jpg"
+	case "png":
+		return ".png"
+	case "webp":
+		return ".webp"
+	case "avif":
+		return ".avif"
+	case "gif":
+		return ".gif"
+	default:
+		return ".jpg"
 	}
 }
 
@@ -86,7 +154,7 @@ func (ip *ImageProcessor) isValidImageFormat(filename string) bool {
 	return supportedFormats[ext]
 }
 
-func (ip *ImageProcessor) resizeImage(img image.Image, size ImageSize) image.Image {
+func resizeImage(img image.Image, size ImageSize) image.Image {
 	format := size.Format
 	if format == "" {
 		format = "default"
@@ -112,50 +180,118 @@ func (ip *ImageProcessor) processImage(ctx context.Context, bucket, key string)
 		return fmt.Errorf("source bucket (%s) and destination bucket (%s) cannot be the same to prevent infinite loops", bucket, ip.destinationBucket)
 	}
 
-	originalImage, format, metadata, err := ip.downloadImage(ctx, bucket, key)
+	rawData, metadata, err := ip.fetchSourceObject(ctx, bucket, key)
 	if err != nil {
 		return fmt.Errorf("failed to download image: %w", err)
 	}
 
+	markerKey := fmt.Sprintf("_processed/%s.json", contentHash(bucket, key, rawData, imageSizes, ip.outputFormats))
+	if marker, ok := ip.loadProcessedMarker(ctx, markerKey); ok {
+		log.Printf("Skipping already-processed %s (idempotency marker %s)", key, markerKey)
+		if marker.Webhook != nil && ip.notifier.IsConfigured() {
+			if err := ip.notifier.sendWebhook(marker.Webhook); err != nil {
+				log.Printf("Failed to replay cached webhook notification: %v", err)
+			}
+		}
+		return nil
+	}
+
 	isReplacement := false
 	if metadata.ExistingFile != "" {
 		isReplacement = true
 	}
 
+	// The veto check only needs the object's header metadata, so it runs
+	// before decodeImageAttributes - the expensive part (decode plus EXIF/
+	// dominant-color/blurhash) - rather than after it, so a veto actually
+	// skips that cost instead of just the resize/upload fan-out.
+	if ip.notifier.IsConfigured() {
+		veto, err := ip.notifier.SendPreProcessingNotification(bucket, key, metadata)
+		if err != nil {
+			log.Printf("Pre-processing webhook failed, continuing with processing: %v", err)
+		} else if veto {
+			log.Printf("Pre-processing webhook vetoed processing for %s", key)
+			return nil
+		}
+	}
+
+	originalImage, format, err := decodeImageAttributes(rawData, metadata)
+	if err != nil {
+		return err
+	}
+
 	dir := filepath.Dir(key)
 	baseName := strings.TrimSuffix(filepath.Base(key), filepath.Ext(key))
-	originalExt := filepath.Ext(key)
 
-	// Process images in parallel
-	g, gCtx := errgroup.WithContext(ctx)
+	// Process images in parallel, fanning out across every (size x format)
+	// combination so e.g. OUTPUT_FORMATS=webp,avif,jpeg yields one derivative
+	// per size per format. A plain errgroup.Group (not WithContext) is used
+	// deliberately: one failing combination (e.g. avif without -tags avif)
+	// must not cancel the others' in-flight uploads via ctx, so every
+	// derivative that can succeed still does.
+	var g errgroup.Group
 	semaphore := make(chan struct{}, runtime.NumCPU())
 
+	var mu sync.Mutex
+	var processed []ProcessedDerivative
+
 	for _, size := range imageSizes {
-		size := size            // capture loop variable
-		semaphore <- struct{}{} // acquire semaphore
+		size := size // capture loop variable
 
-		g.Go(func() error {
-			defer func() { <-semaphore }() // release semaphore
+		// Resize once per size and share the result across every output
+		// format for that size, instead of redoing the same resample work
+		// once per format.
+		resizedImage := resizeImage(originalImage, size)
 
-			resizedImage := ip.resizeImage(originalImage, size)
-			newKey := filepath.Join(dir, fmt.Sprintf("%s_%s%s", baseName, size.Name, originalExt))
+		outFormats := size.Formats
+		if len(outFormats) == 0 {
+			outFormats = ip.outputFormats
+		}
+		if len(outFormats) == 0 {
+			outFormats = []string{format}
+		}
 
-			if err := ip.uploadImage(gCtx, ip.destinationBucket, newKey, resizedImage, format); err != nil {
-				return fmt.Errorf("failed to upload resized image %s: %w", newKey, err)
-			}
+		for _, outFormat := range outFormats {
+			outFormat := outFormat  // capture loop variable
+			semaphore <- struct{}{} // acquire semaphore
 
-			log.Printf("Successfully created %s", newKey)
-			return nil
-		})
+			g.Go(func() error {
+				defer func() { <-semaphore }() // release semaphore
+
+				newKey := filepath.Join(dir, fmt.Sprintf("%s_%s%s", baseName, size.Name, extensionForFormat(outFormat)))
+
+				if err := ip.uploadImage(ctx, ip.destinationBucket, newKey, resizedImage, outFormat, metadata.Raw); err != nil {
+					return fmt.Errorf("failed to upload resized image %s: %w", newKey, err)
+				}
+
+				mu.Lock()
+				processed = append(processed, ProcessedDerivative{Size: size, Format: outFormat, Key: newKey})
+				mu.Unlock()
+
+				log.Printf("Successfully created %s", newKey)
+				return nil
+			})
+		}
 	}
 
-	if err := g.Wait(); err != nil {
-		return err
+	procErr := g.Wait()
+	if procErr != nil {
+		// A single failing combination (e.g. avif on a non-avif build)
+		// already left its successfully-uploaded siblings in place above.
+		// But withhold the image_processed webhook and the idempotency
+		// marker here: if this config can never fully succeed, the caller
+		// (Lambda, or the SQS consumer via visibility timeout) retries
+		// this event indefinitely, and sending a "complete" webhook on
+		// every retry would flood consumers with duplicate, misleadingly-
+		// final notifications for the same image.
+		log.Printf("One or more derivatives failed for %s, withholding webhook/marker: %v", key, procErr)
+		return procErr
 	}
 
-	// Send webhook notification after all sizes are processed
+	var webhookPayload *WebhookPayload
 	if ip.notifier.IsConfigured() {
-		if err := ip.notifier.SendImageProcessedNotification(bucket, key, ip.destinationBucket, imageSizes, metadata.BrandID, metadata.EntityType, metadata.EntityID, metadata.RequestedBy, isReplacement); err != nil {
+		webhookPayload = ip.notifier.buildImageProcessedPayload(bucket, key, ip.destinationBucket, processed, isReplacement, metadata)
+		if err := ip.notifier.sendWebhook(webhookPayload); err != nil {
 			log.Printf("Failed to send webhook notification: %v", err)
 			// Don't return error - image processing was successful
 		} else {
@@ -163,99 +299,245 @@ func (ip *ImageProcessor) processImage(ctx context.Context, bucket, key string)
 		}
 	}
 
+	ip.writeProcessedMarker(ctx, markerKey, processed, webhookPayload)
+
 	return nil
 }
 
+// contentHash derives a stable idempotency key from the source object's
+// bucket/key, its bytes, and the size/format configuration that will be
+// applied to them. The bucket/key is included so that byte-identical
+// source images uploaded under different keys (e.g. the same stock photo
+// for two different EntityIDs) don't collide on the same marker; the
+// format configuration is included so that reprocessing the same object
+// under a different OUTPUT_FORMATS still gets a distinct marker.
+func contentHash(bucket, key string, data []byte, sizes []ImageSize, outputFormats []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s\n", bucket, key)
+	h.Write(data)
+	for _, s := range sizes {
+		fmt.Fprintf(h, "|%s:%dx%d:%s:%v", s.Name, s.Width, s.Height, s.Format, s.Formats)
+	}
+	fmt.Fprintf(h, "|outputFormats:%v", outputFormats)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadProcessedMarker reads the idempotency marker at markerKey, if any,
+// and confirms every derivative it lists still exists in the destination
+// bucket (a HEAD check per derivative) before trusting it.
+func (ip *ImageProcessor) loadProcessedMarker(ctx context.Context, markerKey string) (*processedMarker, bool) {
+	body, _, err := ip.store.Get(ctx, ip.destinationBucket, markerKey)
+	if err != nil {
+		return nil, false
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false
+	}
+
+	var marker processedMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, false
+	}
+
+	for _, d := range marker.Derivatives {
+		exists, err := ip.store.Exists(ctx, ip.destinationBucket, d.Key)
+		if err != nil || !exists {
+			return nil, false
+		}
+	}
+
+	return &marker, true
+}
+
+// writeProcessedMarker persists the idempotency marker for a completed run.
+// Failures are logged, not returned: processing already succeeded, and a
+// missing marker only costs a redundant reprocess on redelivery.
+func (ip *ImageProcessor) writeProcessedMarker(ctx context.Context, markerKey string, processed []ProcessedDerivative, webhookPayload *WebhookPayload) {
+	data, err := json.Marshal(processedMarker{Derivatives: processed, Webhook: webhookPayload})
+	if err != nil {
+		log.Printf("Failed to marshal processed marker %s: %v", markerKey, err)
+		return
+	}
+
+	if err := ip.store.Put(ctx, ip.destinationBucket, markerKey, bytes.NewReader(data), "application/json", nil); err != nil {
+		log.Printf("Failed to write processed marker %s: %v", markerKey, err)
+	}
+}
+
+// ImageMetadata carries both the user-defined metadata attached to the
+// source object and attributes derived from the image itself. The full
+// struct is propagated to the processed-image webhook, and Raw is copied
+// onto every derivative so the destination bucket preserves lineage.
 type ImageMetadata struct {
 	BrandID      string
 	EntityType   string
 	EntityID     string
 	RequestedBy  string
 	ExistingFile string
+	Raw          map[string]string // full user-defined metadata read from the source object
+
+	Width         int
+	Height        int
+	Orientation   int
+	DominantColor string
+	Blurhash      string
+	MIMEType      string
+}
+
+// lookupMetadata reads key from metadata case-insensitively. S3/MinIO
+// canonicalize user metadata to HTTP header casing (e.g. "Brandid"), while
+// GCS/Azure return the map verbatim with whatever casing the uploader used,
+// so matching one backend's casing exactly would silently miss the others.
+func lookupMetadata(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
 }
 
-func (ip *ImageProcessor) downloadImage(ctx context.Context, bucket, key string) (image.Image, string, *ImageMetadata, error) {
-	result, err := ip.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+// fetchSourceObject downloads the source object's bytes and header
+// metadata, without decoding it. Kept separate from decodeImageAttributes
+// so callers can run the pre-processing veto webhook - which only needs
+// this header metadata - before paying for the decode.
+func (ip *ImageProcessor) fetchSourceObject(ctx context.Context, bucket, key string) ([]byte, *ImageMetadata, error) {
+	body, objMetadata, err := ip.store.Get(ctx, bucket, key)
 	if err != nil {
-		return nil, "", nil, err
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	log.Printf("METADATA: %+v", objMetadata)
+	raw := make(map[string]string, len(objMetadata))
+	for k, v := range objMetadata {
+		if k == "Content-Type" {
+			continue
+		}
+		raw[k] = v
 	}
-	defer result.Body.Close()
 
-	log.Printf("METADATA: %+v", result.Metadata)
-	// Extract metadata from S3 object
 	metadata := &ImageMetadata{
-		BrandID:      getMetadataValue(result.Metadata, "Brandid"),
-		EntityType:   getMetadataValue(result.Metadata, "Entitytype"),
-		EntityID:     getMetadataValue(result.Metadata, "Entityid"),
-		RequestedBy:  getMetadataValue(result.Metadata, "Requestedby"),
-		ExistingFile: getMetadataValue(result.Metadata, "Existingfile"),
+		BrandID:      lookupMetadata(objMetadata, "BrandID"),
+		EntityType:   lookupMetadata(objMetadata, "EntityType"),
+		EntityID:     lookupMetadata(objMetadata, "EntityID"),
+		RequestedBy:  lookupMetadata(objMetadata, "RequestedBy"),
+		ExistingFile: lookupMetadata(objMetadata, "ExistingFile"),
+		Raw:          raw,
 	}
 
-	data, err := io.ReadAll(result.Body)
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return nil, "", nil, err
+		return nil, nil, err
 	}
 
+	return data, metadata, nil
+}
+
+// decodeImageAttributes decodes data and fills in metadata's pixel-derived
+// fields (dimensions, EXIF orientation, dominant color, blurhash, MIME
+// type). This is the expensive part of processing a source object, so it
+// runs after the pre-processing veto check has had a chance to skip it.
+func decodeImageAttributes(data []byte, metadata *ImageMetadata) (image.Image, string, error) {
 	img, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, "", nil, fmt.Errorf("failed to decode image: %w", err)
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
 	}
 
-	return img, format, metadata, nil
-}
+	bounds := img.Bounds()
+	metadata.Width = bounds.Dx()
+	metadata.Height = bounds.Dy()
+	metadata.Orientation = extractEXIFOrientation(data)
+	metadata.DominantColor = dominantColor(img)
+	metadata.Blurhash = computeBlurhash(img)
+	metadata.MIMEType = detectMIMEType(data)
 
-func getMetadataValue(metadata map[string]*string, key string) string {
-	if value, exists := metadata[key]; exists && value != nil {
-		return *value
-	}
-	return ""
+	return img, format, nil
 }
 
-func (ip *ImageProcessor) uploadImage(ctx context.Context, bucket, key string, img image.Image, format string) error {
+// encodeImage encodes img in the given format, returning the encoded bytes
+// and the Content-Type to upload/serve them with. Shared by the S3-event
+// pipeline and the on-demand HTTP resize handler.
+func encodeImage(format string, img image.Image) ([]byte, string, error) {
 	var buf bytes.Buffer
 	var contentType string
 
 	switch format {
 	case "jpeg":
 		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
-			return err
+			return nil, "", err
 		}
 		contentType = "image/jpeg"
 	case "png":
 		if err := png.Encode(&buf, img); err != nil {
-			return err
+			return nil, "", err
 		}
 		contentType = "image/png"
 	case "webp":
-		// For WebP output, convert to JPEG with high quality
-		// This is a reasonable fallback since WebP encoding requires CGO
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
-			return err
+		if err := encodeWebP(&buf, img); err != nil {
+			return nil, "", err
 		}
-		contentType = "image/jpeg"
+		contentType = "image/webp"
+	case "avif":
+		if err := encodeAVIF(&buf, img); err != nil {
+			return nil, "", err
+		}
+		contentType = "image/avif"
 	case "gif":
 		if err := gif.Encode(&buf, img, nil); err != nil {
-			return err
+			return nil, "", err
 		}
 		contentType = "image/gif"
 	default:
-		return fmt.Errorf("unsupported format: %s", format)
+		return nil, "", fmt.Errorf("unsupported format: %s", format)
+	}
+
+	return buf.Bytes(), contentType, nil
+}
+
+func (ip *ImageProcessor) uploadImage(ctx context.Context, bucket, key string, img image.Image, format string, metadata map[string]string) error {
+	data, contentType, err := encodeImage(format, img)
+	if err != nil {
+		return err
 	}
 
-	_, err := ip.s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(bucket),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(buf.Bytes()),
-		ContentType: aws.String(contentType),
-	})
+	return ip.store.Put(ctx, bucket, key, bytes.NewReader(data), contentType, metadata)
+}
 
-	return err
+// envOrDefault returns the value of the given environment variable, or
+// fallback if it is unset or empty.
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
 }
 
 func main() {
-	processor := NewImageProcessor()
-	lambda.Start(processor.HandleS3Event)
+	maxConcurrent := flag.Int("max-concurrent", runtime.NumCPU(), "maximum number of concurrent image-processing invocations (consumer mode only)")
+	flag.Parse()
+
+	switch strings.ToLower(os.Getenv("MODE")) {
+	case "http":
+		handler := NewResizeHandler()
+		addr := ":" + envOrDefault("PORT", "8080")
+		log.Printf("Starting on-demand resize HTTP handler on %s", addr)
+		log.Fatal(http.ListenAndServe(addr, handler))
+	case "consumer":
+		processor := NewImageProcessor()
+		consumer := NewEventConsumer(processor, *maxConcurrent)
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		if err := consumer.Run(ctx); err != nil {
+			log.Fatalf("Event consumer exited with error: %v", err)
+		}
+	default:
+		processor := NewImageProcessor()
+		lambda.Start(processor.HandleS3Event)
+	}
 }
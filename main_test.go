@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestContentHashDiffersByBucketAndKey(t *testing.T) {
+	data := []byte("identical source bytes")
+
+	h1 := contentHash("brand-a-bucket", "stock/photo.jpg", data, imageSizes, nil)
+	h2 := contentHash("brand-b-bucket", "stock/photo.jpg", data, imageSizes, nil)
+	if h1 == h2 {
+		t.Fatalf("expected different hashes for different buckets, got %s for both", h1)
+	}
+
+	h3 := contentHash("brand-a-bucket", "stock/photo-for-entity-1.jpg", data, imageSizes, nil)
+	h4 := contentHash("brand-a-bucket", "stock/photo-for-entity-2.jpg", data, imageSizes, nil)
+	if h3 == h4 {
+		t.Fatalf("expected different hashes for different keys, got %s for both", h3)
+	}
+}
+
+func TestContentHashDiffersByOutputFormats(t *testing.T) {
+	data := []byte("identical source bytes")
+
+	h1 := contentHash("bucket", "key.jpg", data, imageSizes, []string{"jpeg"})
+	h2 := contentHash("bucket", "key.jpg", data, imageSizes, []string{"jpeg", "avif"})
+	if h1 == h2 {
+		t.Fatalf("expected different hashes for different outputFormats, got %s for both", h1)
+	}
+}
+
+func TestContentHashStableForIdenticalInputs(t *testing.T) {
+	data := []byte("identical source bytes")
+
+	h1 := contentHash("bucket", "key.jpg", data, imageSizes, []string{"jpeg"})
+	h2 := contentHash("bucket", "key.jpg", data, imageSizes, []string{"jpeg"})
+	if h1 != h2 {
+		t.Fatalf("expected the same inputs to hash identically, got %s and %s", h1, h2)
+	}
+}
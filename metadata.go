@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// blurhashXComponents and blurhashYComponents control the resolution of the
+// generated blurhash, matching the defaults most blurhash clients expect.
+const (
+	blurhashXComponents = 4
+	blurhashYComponents = 3
+)
+
+// extractEXIFOrientation reads the EXIF orientation tag from raw image
+// bytes, returning 1 (the EXIF default, "no transform needed") if the image
+// has no EXIF data or no orientation tag.
+func extractEXIFOrientation(data []byte) int {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+	if err != nil {
+		return 1
+	}
+	return orientation
+}
+
+// dominantColor approximates the image's dominant color by downsampling it
+// to a single pixel, returning it as a "#rrggbb" hex string.
+func dominantColor(img image.Image) string {
+	sample := imaging.Resize(img, 1, 1, imaging.Linear)
+	r, g, b, _ := sample.At(0, 0).RGBA()
+	c := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8)}
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// computeBlurhash encodes img as a blurhash placeholder string. Errors are
+// swallowed and reported as an empty string since a missing placeholder
+// shouldn't fail image processing.
+func computeBlurhash(img image.Image) string {
+	hash, err := blurhash.Encode(blurhashXComponents, blurhashYComponents, img)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// detectMIMEType sniffs the MIME type of raw image bytes the same way
+// net/http does for the Content-Type header.
+func detectMIMEType(data []byte) string {
+	return http.DetectContentType(data)
+}
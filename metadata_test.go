@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestLookupMetadataIsCaseInsensitive(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"s3-header-canonicalized", map[string]string{"Brandid": "acme"}},
+		{"verbatim-lowercase", map[string]string{"brandid": "acme"}},
+		{"verbatim-camel-case", map[string]string{"BrandID": "acme"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := lookupMetadata(tc.metadata, "BrandID"); got != "acme" {
+				t.Fatalf("lookupMetadata() = %q, want %q", got, "acme")
+			}
+		})
+	}
+}
+
+func TestLookupMetadataMissingKey(t *testing.T) {
+	if got := lookupMetadata(map[string]string{"Other": "value"}, "BrandID"); got != "" {
+		t.Fatalf("lookupMetadata() = %q, want empty string for missing key", got)
+	}
+}
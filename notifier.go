@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,100 +24,216 @@ type ImageSizeInfo struct {
 	Key    string `json:"key"`    // S3 key
 	Width  int    `json:"width"`  // target width
 	Height int    `json:"height"` // target height
+	Format string `json:"format"` // encoding of this derivative: jpeg, png, webp, avif, gif
 }
 
 // WebhookPayload represents the notification payload for image processing
 type WebhookPayload struct {
-	OriginalFile  string          `json:"original_file"`  // original file key
-	OriginalURL   string          `json:"original_url"`   // original file URL
-	Bucket        string          `json:"bucket"`         // S3 bucket name
-	ProcessedAt   string          `json:"processed_at"`   // timestamp
-	Environment   string          `json:"environment"`    // deployment environment
-	TotalSizes    int             `json:"total_sizes"`    // number of sizes created
-	ImageSizes    []ImageSizeInfo `json:"image_sizes"`    // array of processed sizes
-	EventType     string          `json:"event_type"`     // always "image_processed"
+	OriginalFile   string            `json:"original_file"`             // original file key
+	OriginalURL    string            `json:"original_url"`              // original file URL
+	Bucket         string            `json:"bucket"`                    // S3 bucket name
+	ProcessedAt    string            `json:"processed_at"`              // timestamp
+	Environment    string            `json:"environment"`               // deployment environment
+	TotalSizes     int               `json:"total_sizes"`               // number of sizes created
+	ImageSizes     []ImageSizeInfo   `json:"image_sizes"`               // array of processed sizes
+	EventType      string            `json:"event_type"`                // always "image_processed"
+	IsReplacement  bool              `json:"is_replacement"`            // true if this file replaced an existing one
+	BrandID        string            `json:"brand_id,omitempty"`        // caller-supplied brand identifier
+	EntityType     string            `json:"entity_type,omitempty"`     // caller-supplied entity type
+	EntityID       string            `json:"entity_id,omitempty"`       // caller-supplied entity identifier
+	RequestedBy    string            `json:"requested_by,omitempty"`    // caller-supplied requester identifier
+	ObjectMetadata map[string]string `json:"object_metadata,omitempty"` // full user-defined metadata on the source object
+	Width          int               `json:"width,omitempty"`           // original image width in pixels
+	Height         int               `json:"height,omitempty"`          // original image height in pixels
+	Orientation    int               `json:"orientation,omitempty"`     // EXIF orientation (1 = normal)
+	DominantColor  string            `json:"dominant_color,omitempty"`  // approximate dominant color, "#rrggbb"
+	Blurhash       string            `json:"blurhash,omitempty"`        // blurhash placeholder for the original image
+	MIMEType       string            `json:"mime_type,omitempty"`       // detected MIME type of the original image
+}
+
+// PreProcessingPayload is sent before resizing begins, giving consumers a
+// chance to veto processing: a 4xx response skips the image entirely.
+type PreProcessingPayload struct {
+	OriginalFile   string            `json:"original_file"`
+	OriginalURL    string            `json:"original_url"`
+	Bucket         string            `json:"bucket"`
+	EventType      string            `json:"event_type"` // always "pre_processing"
+	ObjectMetadata map[string]string `json:"object_metadata,omitempty"`
 }
 
 // Notifier handles webhook notifications
 type Notifier struct {
-	webhookURL    string
-	webhookSecret string
-	region        string
-	client        *http.Client
+	webhookURL     string
+	webhookSecret  string
+	region         string
+	storageBackend string
+	minioEndpoint  string
+	minioUseSSL    bool
+	azureAccount   string
+	client         *http.Client
+
+	// store and destinationBucket let the notifier persist webhooks that
+	// exhaust their retries under _failed_webhooks/ for later replay.
+	store             ObjectStore
+	destinationBucket string
+
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
 }
 
-// NewNotifier creates a new notifier instance
-func NewNotifier() *Notifier {
+// NewNotifier creates a new notifier instance. store and destinationBucket
+// are used only to persist webhooks that exhaust WEBHOOK_MAX_RETRIES.
+func NewNotifier(store ObjectStore, destinationBucket string) *Notifier {
+	useSSL, _ := strconv.ParseBool(os.Getenv("MINIO_USE_SSL"))
 	return &Notifier{
-		webhookURL:    os.Getenv("WEBHOOK_URL"),
-		webhookSecret: os.Getenv("WEBHOOK_SECRET"),
-		region:        os.Getenv("AWS_REGION"),
+		webhookURL:        os.Getenv("WEBHOOK_URL"),
+		webhookSecret:     os.Getenv("WEBHOOK_SECRET"),
+		region:            os.Getenv("AWS_REGION"),
+		storageBackend:    strings.ToLower(os.Getenv("STORAGE_BACKEND")),
+		minioEndpoint:     os.Getenv("MINIO_ENDPOINT"),
+		minioUseSSL:       useSSL,
+		azureAccount:      os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		store:             store,
+		destinationBucket: destinationBucket,
+		maxRetries:        envIntOrDefault("WEBHOOK_MAX_RETRIES", 3),
+		baseDelay:         time.Duration(envIntOrDefault("WEBHOOK_BASE_DELAY_MS", 1000)) * time.Millisecond,
+		maxDelay:          time.Duration(envIntOrDefault("WEBHOOK_MAX_DELAY_MS", 30000)) * time.Millisecond,
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
 	}
 }
 
+// envIntOrDefault parses the given environment variable as an int,
+// returning fallback if it is unset or invalid.
+func envIntOrDefault(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
 // IsConfigured checks if webhook is properly configured
 func (n *Notifier) IsConfigured() bool {
 	return n.webhookURL != ""
 }
 
 // SendImageProcessedNotification sends notification about processed image
-func (n *Notifier) SendImageProcessedNotification(bucket, originalKey string, processedSizes []ImageSize) error {
+func (n *Notifier) SendImageProcessedNotification(sourceBucket, originalKey, destinationBucket string, processed []ProcessedDerivative, isReplacement bool, metadata *ImageMetadata) error {
 	if !n.IsConfigured() {
 		log.Printf("Webhook not configured, skipping notification")
 		return nil
 	}
 
-	// Build image sizes info
-	imageSizes := make([]ImageSizeInfo, 0, len(processedSizes))
-	
-	for _, size := range processedSizes {
-		// Generate the processed file key (following same pattern as main.go)
-		dir := getFileDir(originalKey)
-		baseName := getFileBaseName(originalKey)
-		ext := getFileExt(originalKey)
-		
-		processedKey := fmt.Sprintf("%s/%s_%s%s", dir, baseName, size.Name, ext)
-		if dir == "" {
-			processedKey = fmt.Sprintf("%s_%s%s", baseName, size.Name, ext)
-		}
-		
-		imageSize := ImageSizeInfo{
-			Name:   size.Name,
-			URL:    n.generateFileURL(bucket, processedKey),
-			Key:    processedKey,
-			Width:  size.Width,
-			Height: size.Height,
-		}
-		imageSizes = append(imageSizes, imageSize)
+	payload := n.buildImageProcessedPayload(sourceBucket, originalKey, destinationBucket, processed, isReplacement, metadata)
+	return n.sendWebhook(payload)
+}
+
+// buildImageProcessedPayload assembles the image_processed webhook payload.
+// Exposed separately from SendImageProcessedNotification so processImage can
+// cache the exact payload in a _processed/ idempotency marker and replay it
+// verbatim on a later duplicate delivery.
+func (n *Notifier) buildImageProcessedPayload(sourceBucket, originalKey, destinationBucket string, processed []ProcessedDerivative, isReplacement bool, metadata *ImageMetadata) *WebhookPayload {
+	// Build image sizes info from the derivatives actually produced
+	imageSizes := make([]ImageSizeInfo, 0, len(processed))
+	for _, d := range processed {
+		imageSizes = append(imageSizes, ImageSizeInfo{
+			Name:   d.Size.Name,
+			URL:    n.generateFileURL(destinationBucket, d.Key),
+			Key:    d.Key,
+			Width:  d.Size.Width,
+			Height: d.Size.Height,
+			Format: d.Format,
+		})
 	}
 
 	payload := &WebhookPayload{
-		OriginalFile: originalKey,
-		OriginalURL:  n.generateFileURL(bucket, originalKey),
+		OriginalFile:  originalKey,
+		OriginalURL:   n.generateFileURL(sourceBucket, originalKey),
+		Bucket:        destinationBucket,
+		ProcessedAt:   time.Now().UTC().Format(time.RFC3339),
+		Environment:   os.Getenv("ENVIRONMENT"),
+		TotalSizes:    len(imageSizes),
+		ImageSizes:    imageSizes,
+		EventType:     "image_processed",
+		IsReplacement: isReplacement,
+	}
+
+	if metadata != nil {
+		payload.BrandID = metadata.BrandID
+		payload.EntityType = metadata.EntityType
+		payload.EntityID = metadata.EntityID
+		payload.RequestedBy = metadata.RequestedBy
+		payload.ObjectMetadata = metadata.Raw
+		payload.Width = metadata.Width
+		payload.Height = metadata.Height
+		payload.Orientation = metadata.Orientation
+		payload.DominantColor = metadata.DominantColor
+		payload.Blurhash = metadata.Blurhash
+		payload.MIMEType = metadata.MIMEType
+	}
+
+	return payload
+}
+
+// SendPreProcessingNotification notifies the webhook before resizing
+// begins. If the webhook responds with a 4xx status, veto is true and the
+// caller should skip processing this object.
+func (n *Notifier) SendPreProcessingNotification(bucket, key string, metadata *ImageMetadata) (veto bool, err error) {
+	if !n.IsConfigured() {
+		return false, nil
+	}
+
+	payload := &PreProcessingPayload{
+		OriginalFile: key,
+		OriginalURL:  n.generateFileURL(bucket, key),
 		Bucket:       bucket,
-		ProcessedAt:  time.Now().UTC().Format(time.RFC3339),
-		Environment:  os.Getenv("ENVIRONMENT"),
-		TotalSizes:   len(imageSizes),
-		ImageSizes:   imageSizes,
-		EventType:    "image_processed",
+		EventType:    "pre_processing",
+	}
+	if metadata != nil {
+		payload.ObjectMetadata = metadata.Raw
 	}
 
-	return n.sendWebhook(payload)
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal pre-processing payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", n.webhookURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return false, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "endless-image-processor-lambda")
+	req.Header.Set("X-EC-Signature", n.calculateSignature(jsonData))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("pre-processing webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode >= 400 && resp.StatusCode < 500, nil
 }
 
-// sendWebhook sends the webhook with retry logic
+// sendWebhook sends the webhook with retry logic. Retry policy is
+// configurable via WEBHOOK_MAX_RETRIES, WEBHOOK_BASE_DELAY_MS, and
+// WEBHOOK_MAX_DELAY_MS. If every attempt fails, the payload is persisted
+// under _failed_webhooks/ for a separate replay tool to pick up later.
 func (n *Notifier) sendWebhook(payload *WebhookPayload) error {
-	const maxRetries = 3
-	const baseDelay = time.Second
+	maxRetries := n.maxRetries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
 
 	var lastErr error
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			delay := baseDelay * time.Duration(1<<(attempt-1))
+			delay := n.retryDelay(attempt)
 			log.Printf("Retrying webhook notification (attempt %d/%d) after %v", attempt+1, maxRetries, delay)
 			time.Sleep(delay)
 		}
@@ -128,9 +248,62 @@ func (n *Notifier) sendWebhook(payload *WebhookPayload) error {
 		log.Printf("Webhook notification failed (attempt %d/%d): %v", attempt+1, maxRetries, err)
 	}
 
+	if err := n.persistFailedWebhook(payload, lastErr); err != nil {
+		log.Printf("Failed to persist failed webhook for replay: %v", err)
+	}
+
 	return fmt.Errorf("webhook notification failed after %d attempts: %w", maxRetries, lastErr)
 }
 
+// retryDelay computes exponential backoff from baseDelay, capped at
+// maxDelay, with up to 20% jitter so retries from concurrent invocations
+// don't all land at once.
+func (n *Notifier) retryDelay(attempt int) time.Duration {
+	delay := n.baseDelay
+	for i := 1; i < attempt && (n.maxDelay <= 0 || delay < n.maxDelay); i++ {
+		delay *= 2
+	}
+	if n.maxDelay > 0 && delay > n.maxDelay {
+		delay = n.maxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	return delay + jitter
+}
+
+// failedWebhookRecord is the JSON body persisted under _failed_webhooks/
+// when a webhook exhausts its retries, so a separate replay tool can retry
+// it later.
+type failedWebhookRecord struct {
+	Payload  *WebhookPayload `json:"payload"`
+	Error    string          `json:"error"`
+	FailedAt string          `json:"failed_at"`
+}
+
+// persistFailedWebhook writes payload and the error that caused it to
+// exhaust retries to _failed_webhooks/<hash>.json in the destination
+// bucket. A no-op if the notifier wasn't given a store to write to.
+func (n *Notifier) persistFailedWebhook(payload *WebhookPayload, sendErr error) error {
+	if n.store == nil || n.destinationBucket == "" {
+		return nil
+	}
+
+	record := failedWebhookRecord{
+		Payload:  payload,
+		Error:    sendErr.Error(),
+		FailedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failed-webhook record: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	key := fmt.Sprintf("_failed_webhooks/%x.json", sum)
+
+	return n.store.Put(context.Background(), n.destinationBucket, key, bytes.NewReader(data), "application/json", nil)
+}
+
 // sendSingleWebhook performs a single webhook attempt
 func (n *Notifier) sendSingleWebhook(payload *WebhookPayload) error {
 	jsonData, err := json.Marshal(payload)
@@ -164,85 +337,44 @@ func (n *Notifier) sendSingleWebhook(payload *WebhookPayload) error {
 
 // calculateSignature generates HMAC-SHA256 signature for webhook validation
 func (n *Notifier) calculateSignature(jsonData []byte) string {
-	if n.webhookSecret == "" {
+	sum := hmacSHA256Hex(n.webhookSecret, jsonData)
+	if sum == "" {
 		return ""
 	}
-	
-	mac := hmac.New(sha256.New, []byte(n.webhookSecret))
-	mac.Write(jsonData)
-	signature := hex.EncodeToString(mac.Sum(nil))
-	
-	return "sha256=" + signature
+	return "sha256=" + sum
 }
 
-// generateFileURL creates an S3 file URL
-func (n *Notifier) generateFileURL(bucket, key string) string {
-	region := n.region
-	if region == "" {
-		region = "us-east-1" // default fallback
-	}
-	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, key)
-}
-
-// Helper functions to extract file path components
-func getFileDir(key string) string {
-	lastSlash := -1
-	for i := len(key) - 1; i >= 0; i-- {
-		if key[i] == '/' {
-			lastSlash = i
-			break
-		}
-	}
-	if lastSlash == -1 {
+// hmacSHA256Hex computes the hex-encoded HMAC-SHA256 of data using secret.
+// Returns "" if secret is empty. Shared by webhook signing and the on-demand
+// resize handler's signed-URL verification.
+func hmacSHA256Hex(secret string, data []byte) string {
+	if secret == "" {
 		return ""
 	}
-	return key[:lastSlash]
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func getFileBaseName(key string) string {
-	// Get filename without directory
-	lastSlash := -1
-	for i := len(key) - 1; i >= 0; i-- {
-		if key[i] == '/' {
-			lastSlash = i
-			break
+// generateFileURL creates a public URL for an object, in the style of
+// whichever STORAGE_BACKEND is active.
+func (n *Notifier) generateFileURL(bucket, key string) string {
+	switch n.storageBackend {
+	case "minio":
+		scheme := "http"
+		if n.minioUseSSL {
+			scheme = "https"
 		}
-	}
-	
-	filename := key
-	if lastSlash != -1 {
-		filename = key[lastSlash+1:]
-	}
-	
-	// Remove extension
-	lastDot := -1
-	for i := len(filename) - 1; i >= 0; i-- {
-		if filename[i] == '.' {
-			lastDot = i
-			break
+		return fmt.Sprintf("%s://%s/%s/%s", scheme, n.minioEndpoint, bucket, key)
+	case "gcs":
+		return fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, key)
+	case "azblob", "azure":
+		return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", n.azureAccount, bucket, key)
+	default:
+		region := n.region
+		if region == "" {
+			region = "us-east-1" // default fallback
 		}
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, key)
 	}
-	
-	if lastDot == -1 {
-		return filename
-	}
-	return filename[:lastDot]
 }
-
-func getFileExt(key string) string {
-	lastDot := -1
-	for i := len(key) - 1; i >= 0; i-- {
-		if key[i] == '.' {
-			lastDot = i
-			break
-		}
-		if key[i] == '/' {
-			break
-		}
-	}
-	
-	if lastDot == -1 {
-		return ""
-	}
-	return key[lastDot:]
-}
\ No newline at end of file
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ObjectStore abstracts the object-storage backend so the processor can run
+// against S3, MinIO, GCS, or Azure Blob Storage interchangeably. Get returns
+// the object body alongside its metadata, normalized to a plain string map
+// that carries a "Content-Type" key (when the backend reports one) in
+// addition to any user-defined metadata (e.g. BrandID, EntityType) the
+// backend exposes.
+type ObjectStore interface {
+	Get(ctx context.Context, bucket, key string) (io.ReadCloser, map[string]string, error)
+	Put(ctx context.Context, bucket, key string, body io.Reader, contentType string, metadata map[string]string) error
+	// Exists reports whether an object is present, via a HEAD-style call
+	// that doesn't fetch the body. Used to verify idempotency markers.
+	Exists(ctx context.Context, bucket, key string) (bool, error)
+}
+
+// NewObjectStore builds the ObjectStore selected by the STORAGE_BACKEND env
+// var: "aws" (default) for S3, "minio" for MinIO/path-style S3-compatible
+// endpoints, "gcs" for Google Cloud Storage, or "azblob" for Azure Blob
+// Storage.
+func NewObjectStore() (ObjectStore, error) {
+	backend := strings.ToLower(os.Getenv("STORAGE_BACKEND"))
+	switch backend {
+	case "", "aws", "s3":
+		return newS3Store(), nil
+	case "minio":
+		return newMinIOStore()
+	case "gcs":
+		return newGCSStore()
+	case "azblob", "azure":
+		return newAzureBlobStore()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND: %s", backend)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// azureBlobStore implements ObjectStore against Azure Blob Storage, where
+// "bucket" maps to a container and "key" to a blob name. Configured via
+// AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY.
+type azureBlobStore struct {
+	client *azblob.Client
+}
+
+func newAzureBlobStore() (*azureBlobStore, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+
+	cred, err := azblob.NewSharedKeyCredential(account, os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := azblob.NewClientWithSharedKeyCredential(
+		fmt.Sprintf("https://%s.blob.core.windows.net/", account), cred, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &azureBlobStore{client: client}, nil
+}
+
+func (s *azureBlobStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, map[string]string, error) {
+	resp, err := s.client.DownloadStream(ctx, bucket, key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := make(map[string]string, len(resp.Metadata)+1)
+	for k, v := range resp.Metadata {
+		if v != nil {
+			metadata[k] = *v
+		}
+	}
+	if resp.ContentType != nil {
+		metadata["Content-Type"] = *resp.ContentType
+	}
+
+	return resp.Body, metadata, nil
+}
+
+func (s *azureBlobStore) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string, metadata map[string]string) error {
+	meta := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		v := v
+		meta[k] = &v
+	}
+
+	_, err := s.client.UploadStream(ctx, bucket, key, body, &azblob.UploadStreamOptions{
+		Metadata:    meta,
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	return err
+}
+
+func (s *azureBlobStore) Exists(ctx context.Context, bucket, key string) (bool, error) {
+	blobClient := s.client.ServiceClient().NewContainerClient(bucket).NewBlobClient(key)
+	_, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
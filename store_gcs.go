@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// gcsStore implements ObjectStore against Google Cloud Storage. Credentials
+// are resolved the standard way (GOOGLE_APPLICATION_CREDENTIALS or workload
+// identity); there is no endpoint to configure.
+type gcsStore struct {
+	client *storage.Client
+}
+
+func newGCSStore() (*gcsStore, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStore{client: client}, nil
+}
+
+func (s *gcsStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, map[string]string, error) {
+	obj := s.client.Bucket(bucket).Object(key)
+
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := make(map[string]string, len(attrs.Metadata)+1)
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	metadata["Content-Type"] = attrs.ContentType
+
+	return reader, metadata, nil
+}
+
+func (s *gcsStore) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string, metadata map[string]string) error {
+	writer := s.client.Bucket(bucket).Object(key).NewWriter(ctx)
+	writer.ContentType = contentType
+	writer.Metadata = metadata
+
+	if _, err := io.Copy(writer, body); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *gcsStore) Exists(ctx context.Context, bucket, key string) (bool, error) {
+	_, err := s.client.Bucket(bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// minioStore implements ObjectStore against MinIO (or any other
+// S3-compatible endpoint) using path-style addressing, so self-hosted
+// deployments don't depend on virtual-hosted DNS. Configured via
+// MINIO_ENDPOINT, MINIO_ACCESS_KEY, MINIO_SECRET_KEY, and MINIO_USE_SSL.
+type minioStore struct {
+	client *minio.Client
+}
+
+func newMinIOStore() (*minioStore, error) {
+	useSSL, _ := strconv.ParseBool(os.Getenv("MINIO_USE_SSL"))
+
+	client, err := minio.New(os.Getenv("MINIO_ENDPOINT"), &minio.Options{
+		Creds:        credentials.NewStaticV4(os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"), ""),
+		Secure:       useSSL,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &minioStore{client: client}, nil
+}
+
+func (s *minioStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, map[string]string, error) {
+	info, err := s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, err := s.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := make(map[string]string, len(info.UserMetadata)+1)
+	for k, v := range info.UserMetadata {
+		metadata[k] = v
+	}
+	metadata["Content-Type"] = info.ContentType
+
+	return obj, metadata, nil
+}
+
+func (s *minioStore) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string, metadata map[string]string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: metadata,
+	})
+	return err
+}
+
+func (s *minioStore) Exists(ctx context.Context, bucket, key string) (bool, error) {
+	_, err := s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
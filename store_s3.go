@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Store implements ObjectStore against AWS S3. This is the default
+// backend (STORAGE_BACKEND unset, "aws", or "s3").
+type s3Store struct {
+	client *s3.S3
+}
+
+func newS3Store() *s3Store {
+	sess := session.Must(session.NewSession())
+	return &s3Store{client: s3.New(sess)}
+}
+
+func (s *s3Store) Get(ctx context.Context, bucket, key string) (io.ReadCloser, map[string]string, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := make(map[string]string, len(result.Metadata)+1)
+	for k, v := range result.Metadata {
+		if v != nil {
+			metadata[k] = *v
+		}
+	}
+	if result.ContentType != nil {
+		metadata["Content-Type"] = *result.ContentType
+	}
+
+	return result.Body, metadata, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string, metadata map[string]string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	}
+	if len(metadata) > 0 {
+		input.Metadata = make(map[string]*string, len(metadata))
+		for k, v := range metadata {
+			v := v
+			input.Metadata[k] = &v
+		}
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, input)
+	return err
+}
+
+func (s *s3Store) Exists(ctx context.Context, bucket, key string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}